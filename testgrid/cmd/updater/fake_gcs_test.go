@@ -0,0 +1,151 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+)
+
+// fakeObject is one object served by a fakeClient: name is its full GCS
+// object name (e.g. "group/build-1/finished.json"), data is its content,
+// and delay (if set) stalls a media download of it, to simulate a slow or
+// hanging GCS read.
+type fakeObject struct {
+	name  string
+	data  []byte
+	delay time.Duration
+}
+
+// roundTripFunc adapts a func to http.RoundTripper.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// fakeClient returns a real *storage.Client backed by an in-process
+// RoundTripper instead of a network connection, so GCS listing and object
+// reads can be exercised without talking to GCS or a test HTTP listener.
+// listDelay, if set, stalls every Objects.List call (simulating a
+// pathologically slow or hanging listing) in addition to any per-object
+// fakeObject.delay.
+func fakeClient(t *testing.T, objects []fakeObject, listDelay time.Duration) *storage.Client {
+	t.Helper()
+	byName := map[string]fakeObject{}
+	for _, o := range objects {
+		byName[o.name] = o
+	}
+
+	rt := roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		q := r.URL.Query()
+		if q.Get("prefix") != "" || q.Get("delimiter") != "" {
+			if listDelay > 0 {
+				select {
+				case <-time.After(listDelay):
+				case <-r.Context().Done():
+					return nil, r.Context().Err()
+				}
+			}
+			return listResponse(byName, q.Get("prefix"), q.Get("delimiter")), nil
+		}
+
+		path, err := url.PathUnescape(r.URL.Path)
+		if err != nil {
+			path = r.URL.Path
+		}
+		for name, obj := range byName {
+			if !strings.HasSuffix(path, name) {
+				continue
+			}
+			if obj.delay > 0 {
+				select {
+				case <-time.After(obj.delay):
+				case <-r.Context().Done():
+					return nil, r.Context().Err()
+				}
+			}
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       ioutil.NopCloser(bytes.NewReader(obj.data)),
+				Header:     http.Header{"Content-Length": {strconv.Itoa(len(obj.data))}},
+			}, nil
+		}
+		return &http.Response{StatusCode: http.StatusNotFound, Body: ioutil.NopCloser(strings.NewReader(""))}, nil
+	})
+
+	client, err := storage.NewClient(context.Background(), option.WithHTTPClient(&http.Client{Transport: rt}), option.WithoutAuthentication())
+	if err != nil {
+		t.Fatalf("storage.NewClient() returned %v", err)
+	}
+	return client
+}
+
+// listResponse builds a storage#objects JSON listing of every name in
+// byName that starts with prefix, grouping anything after the next
+// delimiter into prefixes the way a real delimiter-bounded GCS listing does.
+func listResponse(byName map[string]fakeObject, prefix, delim string) *http.Response {
+	prefixes := map[string]bool{}
+	var items []string
+	for name := range byName {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(name, prefix)
+		if delim != "" {
+			if idx := strings.Index(rest, delim); idx >= 0 {
+				prefixes[prefix+rest[:idx+len(delim)]] = true
+				continue
+			}
+		}
+		items = append(items, name)
+	}
+
+	var b strings.Builder
+	b.WriteString(`{"kind":"storage#objects","prefixes":[`)
+	first := true
+	for p := range prefixes {
+		if !first {
+			b.WriteString(",")
+		}
+		first = false
+		b.WriteString(strconv.Quote(p))
+	}
+	b.WriteString(`],"items":[`)
+	first = true
+	for _, name := range items {
+		if !first {
+			b.WriteString(",")
+		}
+		first = false
+		b.WriteString(`{"name":` + strconv.Quote(name) + `}`)
+	}
+	b.WriteString(`]}`)
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Body:       ioutil.NopCloser(strings.NewReader(b.String())),
+		Header:     http.Header{"Content-Type": {"application/json"}},
+	}
+}
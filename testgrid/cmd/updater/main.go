@@ -22,6 +22,7 @@ import (
 	"context"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
 	"hash/crc32"
@@ -41,6 +42,8 @@ import (
 
 	"cloud.google.com/go/storage"
 	"github.com/golang/protobuf/proto"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4"
 	"google.golang.org/api/iterator"
 
 	"vbom.ml/util/sortorder"
@@ -48,11 +51,20 @@ import (
 
 // options configures the updater
 type options struct {
-	config           gcsPath // gs://path/to/config/proto
-	creds            string  // TODO(fejta): implement
-	confirm          bool    // TODO(fejta): implement
-	group            string
-	groupConcurrency uint
+	config              gcsPath // gs://path/to/config/proto
+	creds               string  // TODO(fejta): implement
+	confirm             bool    // TODO(fejta): implement
+	group               string
+	groupConcurrency    uint
+	buildConcurrency    uint
+	artifactConcurrency uint
+	doctor              bool
+	doctorJSON          bool
+	gridCodec           string
+	codec               Codec
+	perObjectTimeout    time.Duration
+	perBuildTimeout     time.Duration
+	deadlines           Deadlines
 }
 
 // validate ensures sane options
@@ -66,6 +78,21 @@ func (o *options) validate() error {
 	if o.groupConcurrency == 0 {
 		o.groupConcurrency = uint(4 * runtime.NumCPU())
 	}
+	if o.buildConcurrency == 0 {
+		o.buildConcurrency = uint(4 * runtime.NumCPU())
+	}
+	if o.artifactConcurrency == 0 {
+		o.artifactConcurrency = uint(runtime.NumCPU())
+	}
+	if o.gridCodec == "" {
+		o.gridCodec = "zlib"
+	}
+	codec, err := codecByName(o.gridCodec)
+	if err != nil {
+		return fmt.Errorf("--grid-codec: %v", err)
+	}
+	o.codec = codec
+	o.deadlines = Deadlines{PerObject: o.perObjectTimeout, PerBuild: o.perBuildTimeout}
 
 	return nil
 }
@@ -78,6 +105,13 @@ func gatherOptions() options {
 	flag.BoolVar(&o.confirm, "confirm", false, "Upload data if set")
 	flag.StringVar(&o.group, "test-group", "", "Only update named group if set")
 	flag.UintVar(&o.groupConcurrency, "group-concurrency", 0, "Manually define the number of groups to concurrently update if non-zero")
+	flag.UintVar(&o.buildConcurrency, "build-concurrency", 0, "Manually define the number of builds to concurrently read within a group if non-zero")
+	flag.UintVar(&o.artifactConcurrency, "artifact-concurrency", 0, "Manually define the number of artifacts to concurrently read within a build if non-zero")
+	flag.BoolVar(&o.doctor, "doctor", false, "Audit the config and GCS state instead of writing grids")
+	flag.BoolVar(&o.doctorJSON, "doctor-json", false, "Emit the --doctor report as JSON instead of text")
+	flag.StringVar(&o.gridCodec, "grid-codec", "zlib", "Compression codec to use when uploading grids: zlib, zstd or lz4")
+	flag.DurationVar(&o.perObjectTimeout, "per-object-timeout", 30*time.Second, "Give up reading a single GCS object after this long")
+	flag.DurationVar(&o.perBuildTimeout, "per-build-timeout", 5*time.Minute, "Give up reading an entire build after this long")
 	flag.Parse()
 	return o
 }
@@ -135,11 +169,24 @@ func (g gcsPath) testGroup(name string) gcsPath {
 	return newG
 }
 
+// Deadlines bounds how long ReadBuild (and the listing that feeds it) will
+// wait on a single GCS object, and on an entire build, before giving up.
+// Either may be zero to mean "no deadline".
+type Deadlines struct {
+	PerObject time.Duration
+	PerBuild  time.Duration
+}
+
+// ErrDeadlineExceeded marks a GCS read or list call abandoned because it ran
+// past a Deadlines bound, so callers can log-and-skip rather than abort.
+var ErrDeadlineExceeded = errors.New("gcs call exceeded its deadline")
+
 type Build struct {
-	Bucket  *storage.BucketHandle
-	Context context.Context
-	Prefix  string
-	number  *int
+	Bucket    *storage.BucketHandle
+	Context   context.Context
+	Prefix    string
+	Deadlines Deadlines
+	number    *int
 }
 
 type Started struct {
@@ -491,24 +538,164 @@ func ValidateName(name string) map[string]string {
 
 }
 
-func ReadBuild(build Build) (*Column, error) {
+// ForEachJob invokes fn(ctx, i) for every i in [0, n), using up to
+// concurrency workers. It blocks until every started job has returned; once
+// ctx is cancelled no further jobs are started. The first non-nil error
+// returned by fn cancels the derived
+// context so that in-flight and not-yet-started jobs can abandon their
+// work early, and is returned to the caller.
+func ForEachJob(ctx context.Context, concurrency, n int, fn func(ctx context.Context, i int) error) error {
+	if n == 0 {
+		return nil
+	}
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	if concurrency > n {
+		concurrency = n
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan int)
+	go func() {
+		defer close(jobs)
+		for i := 0; i < n; i++ {
+			select {
+			case jobs <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				if err := fn(ctx, i); err != nil {
+					once.Do(func() {
+						firstErr = err
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// readObject opens obj and reads it to completion, bounding both the open
+// and the read to perObject (derived from ctx) if set. A timeout is reported
+// as ErrDeadlineExceeded so callers can distinguish it from a real GCS error.
+// If maxSize is positive, objects advertising more remaining bytes than that
+// are rejected before they are read.
+func readObject(ctx context.Context, obj *storage.ObjectHandle, perObject time.Duration, maxSize int64) ([]byte, error) {
+	if perObject > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, perObject)
+		defer cancel()
+	}
+	r, err := obj.NewReader(ctx)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("%w: %v", ErrDeadlineExceeded, err)
+		}
+		return nil, err
+	}
+	defer r.Close()
+	if maxSize > 0 {
+		if rem := r.Remain(); rem > maxSize {
+			return nil, fmt.Errorf("too large: %d > %d", rem, maxSize)
+		}
+	}
+	buf, err := ioutil.ReadAll(r)
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, fmt.Errorf("%w: %v", ErrDeadlineExceeded, err)
+		}
+		return nil, err
+	}
+	return buf, nil
+}
+
+// nextAttrs calls it.Next(), bounding the wait to perObject if set. On
+// timeout it returns immediately without waiting for the in-flight call to
+// finish, so a genuinely hung RPC (not merely a slow one) can't block the
+// caller forever; it deliberately never cancels ctx (the iterator's own,
+// usually shared, context) either, since doing so would permanently kill
+// every later page of the same iterator instead of just the one call.
+// Because the abandoned goroutine below is left running, the caller must
+// treat a timeout as terminal for it: another call racing it.Next() against
+// the same iterator is not safe, so callers should stop listing (not retry)
+// once they see ErrDeadlineExceeded here. The goroutine itself is cleaned up
+// once the underlying call errors out or ctx is eventually torn down by the
+// caller (e.g. when listBuilds/ReadBuild return and cancel their iterator's
+// context).
+func nextAttrs(ctx context.Context, it *storage.ObjectIterator, perObject time.Duration) (*storage.ObjectAttrs, error) {
+	if perObject <= 0 {
+		return it.Next()
+	}
+	objCtx, objCancel := context.WithTimeout(ctx, perObject)
+	defer objCancel()
+	type result struct {
+		attrs *storage.ObjectAttrs
+		err   error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		attrs, err := it.Next()
+		ch <- result{attrs, err}
+	}()
+	select {
+	case r := <-ch:
+		return r.attrs, r.err
+	case <-objCtx.Done():
+		return nil, fmt.Errorf("%w: listing objects", ErrDeadlineExceeded)
+	}
+}
+
+// ReadBuild reads the started/finished metadata and artifacts for a single
+// build, fanning the (independent) artifact reads out across up to
+// artifactConcurrency workers via ForEachJob since they dominate the latency
+// of reading a build. This is deliberately a separate knob from the
+// build-level fan-out concurrency in ReadBuilds: reusing that value here
+// would make the number of concurrent GCS reads scale with the square of
+// the caller-supplied concurrency instead of bounding it. Every GCS call is
+// bounded by build.Deadlines so a single slow or hanging object can't stall
+// the whole group's forward progress.
+func ReadBuild(build Build, artifactConcurrency int) (*Column, error) {
+	ctx := build.Context
+	if build.Deadlines.PerBuild > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, build.Deadlines.PerBuild)
+		defer cancel()
+	}
+	build.Context = ctx
+
 	br := Column{
 		Id: path.Base(build.Prefix),
 	}
 	s := build.Bucket.Object(build.Prefix + "started.json")
-	sr, err := s.NewReader(build.Context)
+	sbuf, err := readObject(ctx, s, build.Deadlines.PerObject, 0)
 	if err != nil {
 		return nil, fmt.Errorf("build has not started")
 	}
 	var started Started
-	if err = json.NewDecoder(sr).Decode(&started); err != nil {
+	if err = json.Unmarshal(sbuf, &started); err != nil {
 		return nil, fmt.Errorf("could not decode started.json: %v", err)
 	}
 	br.Started = started.Timestamp
 	br.Rows = map[string][]Row{}
 
 	f := build.Bucket.Object(build.Prefix + "finished.json")
-	fr, err := f.NewReader(build.Context)
+	fbuf, err := readObject(ctx, f, build.Deadlines.PerObject, 0)
 	if err == storage.ErrObjectNotExist {
 		br.Rows["Overall"] = []Row{
 			{
@@ -520,9 +707,12 @@ func ReadBuild(build Build) (*Column, error) {
 		}
 		return &br, nil
 	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read finished.json: %v", err)
+	}
 
 	var finished Finished
-	if err = json.NewDecoder(fr).Decode(&finished); err != nil {
+	if err = json.Unmarshal(fbuf, &finished); err != nil {
 		return nil, fmt.Errorf("could not decode finished.json: %v", err)
 	}
 
@@ -542,13 +732,23 @@ func ReadBuild(build Build) (*Column, error) {
 		},
 	}
 
-	ai := build.Bucket.Objects(build.Context, &storage.Query{Prefix: build.Prefix + "artifacts/"})
+	aiCtx, aiCancel := context.WithCancel(ctx)
+	defer aiCancel()
+	ai := build.Bucket.Objects(aiCtx, &storage.Query{Prefix: build.Prefix + "artifacts/"})
 	artifacts := map[string]map[string]string{}
 	for {
-		a, err := ai.Next()
+		a, err := nextAttrs(aiCtx, ai, build.Deadlines.PerObject)
 		if err == iterator.Done {
 			break
 		}
+		if errors.Is(err, ErrDeadlineExceeded) {
+			// The abandoned Next() call may still be running against ai, so
+			// it's no longer safe to call Next() on it again: stop listing
+			// here and proceed with whatever artifacts were already found,
+			// rather than hanging on (or racing) a call that may be stuck.
+			log.Printf("listing artifacts for %s timed out, proceeding with %d found so far: %v", build.Prefix, len(artifacts), err)
+			break
+		}
 		if err != nil {
 			return nil, fmt.Errorf("failed to list artifacts: %v", err)
 		}
@@ -559,22 +759,28 @@ func ReadBuild(build Build) (*Column, error) {
 		}
 		artifacts[a.Name] = meta
 	}
-	for ap, meta := range artifacts {
-		ar, err := build.Bucket.Object(ap).NewReader(build.Context)
-		if err != nil {
-			return nil, fmt.Errorf("could not read %s: %v", ap, err)
-		}
-		if r := ar.Remain(); r > 50e6 {
-			return nil, fmt.Errorf("too large: %s is %d > 50M", ap, r)
-		}
-		buf, err := ioutil.ReadAll(ar)
+
+	names := make([]string, 0, len(artifacts))
+	for ap := range artifacts {
+		names = append(names, ap)
+	}
+
+	var lock sync.Mutex // extractRows mutates the shared br.Rows map
+	err = ForEachJob(ctx, artifactConcurrency, len(names), func(jobCtx context.Context, i int) error {
+		ap := names[i]
+		buf, err := readObject(jobCtx, build.Bucket.Object(ap), build.Deadlines.PerObject, 50e6)
 		if err != nil {
-			return nil, fmt.Errorf("failed to read all of %s: %v", ap, err)
+			return fmt.Errorf("could not read %s: %v", ap, err)
 		}
-
-		if err = extractRows(buf, br.Rows, meta); err != nil {
-			return nil, fmt.Errorf("failed to parse %s: %v", ap, err)
+		lock.Lock()
+		defer lock.Unlock()
+		if err := extractRows(buf, br.Rows, artifacts[ap]); err != nil {
+			return fmt.Errorf("failed to parse %s: %v", ap, err)
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	return &br, nil
 }
@@ -587,24 +793,41 @@ func (b Builds) Less(i, j int) bool {
 	return sortorder.NaturalLess(b[i].Prefix, b[j].Prefix)
 }
 
-// listBuilds lists and sorts builds under path, sending them to the builds channel.
-func listBuilds(client *storage.Client, ctx context.Context, path gcsPath, builds chan Build) error {
+// listBuilds lists and sorts builds under path, sending them to the builds
+// channel (most-recent-first). deadlines.PerObject bounds each call to the
+// underlying iterator so a pathologically large (or hanging) prefix can't
+// hang the listing forever; a page timing out stops listing early rather
+// than retrying (the iterator isn't safe to reuse once a call has been
+// abandoned), sending along whatever builds were already found instead of
+// returning no builds at all. deadlines.PerBuild is copied onto each Build
+// so ReadBuild applies it later.
+func listBuilds(client *storage.Client, ctx context.Context, path gcsPath, builds chan Build, deadlines Deadlines) error {
 	p := path.object()
 	if p[len(p)-1] != '/' {
 		p += "/"
 	}
 	bkt := client.Bucket(path.bucket())
-	it := bkt.Objects(ctx, &storage.Query{
+	itCtx, itCancel := context.WithCancel(ctx)
+	defer itCancel()
+	it := bkt.Objects(itCtx, &storage.Query{
 		Delimiter: "/",
 		Prefix:    p,
 	})
 	fmt.Println("Looking in ", path.bucket(), p)
 	var all Builds
 	for {
-		objAttrs, err := it.Next()
+		objAttrs, err := nextAttrs(itCtx, it, deadlines.PerObject)
 		if err == iterator.Done {
 			break
 		}
+		if errors.Is(err, ErrDeadlineExceeded) {
+			// The abandoned Next() call may still be running against it, so
+			// it's no longer safe to call Next() on it again: stop listing
+			// here and send along whatever builds were already found,
+			// rather than hanging on (or racing) a call that may be stuck.
+			log.Printf("listing %s timed out, proceeding with %d builds found so far: %v", path, len(all), err)
+			break
+		}
 		if err != nil {
 			return fmt.Errorf("failed to list objects: %v", err)
 		}
@@ -614,9 +837,10 @@ func listBuilds(client *storage.Client, ctx context.Context, path gcsPath, build
 
 		//fmt.Println("Found name:", objAttrs.Name, "prefix:", objAttrs.Prefix)
 		all = append(all, Build{
-			Bucket:  bkt,
-			Context: ctx,
-			Prefix:  objAttrs.Prefix,
+			Bucket:    bkt,
+			Context:   ctx,
+			Prefix:    objAttrs.Prefix,
+			Deadlines: deadlines,
 		})
 	}
 	// Expect builds to be in monotonically increasing order.
@@ -645,40 +869,109 @@ func (r Rows) Less(i, j int) bool {
 	return sortorder.NaturalLess(r[i].Name, r[j].Name)
 }
 
-func ReadBuilds(group config.TestGroup, builds chan Build, max int, dur time.Duration) state.Grid {
-	i := 0
+// ReadBuilds reads every build sent on the builds channel (most-recent-first)
+// using up to concurrency workers, each running ReadBuild in parallel, then
+// reassembles the resulting Columns in that original order before appending
+// them to the grid. Reading stops once max results have been considered or a
+// build's start time falls before the dur cutoff; at that point the context
+// of every build past the cutoff is cancelled so outstanding workers abandon
+// their in-flight reads rather than finish fetching builds we're going to
+// discard, while builds up to the cutoff are still read in full. artifactConcurrency bounds
+// each ReadBuild's own artifact fan-out independently of concurrency, so
+// callers control both factors of the worst-case concurrent GCS reads
+// (concurrency * artifactConcurrency) instead of one flag silently squaring
+// itself.
+func ReadBuilds(parent context.Context, group config.TestGroup, builds chan Build, max int, dur time.Duration, concurrency, artifactConcurrency int) (*state.Grid, error) {
+	var all []Build
+	for b := range builds {
+		all = append(all, b)
+	}
+
 	var stop time.Time
 	if dur != 0 {
 		stop = time.Now().Add(-dur)
 	}
+	log.Printf("Reading builds after %s (%d)", stop, stop.Unix())
+
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	n := len(all)
+	if max > 0 && max < n {
+		n = max
+	}
+	cols := make([]*Column, n)
+	errs := make([]error, n)
+
+	var lock sync.Mutex
+	limit := n // first index (exclusive) that should make it into the grid
+	cancels := make([]context.CancelFunc, n)
+	lower := func(i int) {
+		lock.Lock()
+		if i < limit {
+			limit = i
+			for j := i; j < len(cancels); j++ { // only builds past the new limit
+				if cancels[j] != nil {
+					cancels[j]()
+				}
+			}
+		}
+		lock.Unlock()
+	}
+
+	ForEachJob(ctx, concurrency, n, func(ctx context.Context, i int) error {
+		lock.Lock()
+		skip := i >= limit
+		var jobCancel context.CancelFunc
+		if !skip {
+			ctx, jobCancel = context.WithCancel(ctx)
+			cancels[i] = jobCancel
+		}
+		lock.Unlock()
+		if skip {
+			return nil
+		}
+		defer jobCancel()
+		b := all[i]
+		b.Context = ctx
+		col, err := ReadBuild(b, artifactConcurrency)
+		if err != nil {
+			errs[i] = err
+			return nil
+		}
+		cols[i] = col
+		if col.Started < stop.Unix() {
+			lower(i + 1)
+		}
+		return nil
+	})
+
+	lock.Lock()
+	n = limit
+	lock.Unlock()
+
 	grid := &state.Grid{}
 	h := Headers(group)
 	nc := MakeNameConfig(group.TestNameConfig)
 	rows := map[string]*state.Row{}
-	log.Printf("Reading builds after %s (%d)", stop, stop.Unix())
-	for b := range builds {
-		i++
-		if max > 0 && i > max {
-			log.Printf("Hit ceiling of %d results", max)
-			break
-		}
-		br, err := ReadBuild(b)
-		if err != nil {
-			log.Printf("FAIL %s: %v", b.Prefix, err)
+	for i := 0; i < n; i++ {
+		if err := errs[i]; err != nil {
+			log.Printf("FAIL %s: %v", all[i].Prefix, err)
 			continue
 		}
-		AppendColumn(h, nc, grid, rows, *br)
-		log.Printf("found: %s pass:%t %d-%d: %d results", br.Id, br.Passed, br.Started, br.Finished, len(br.Rows))
-		if br.Started < stop.Unix() {
-			log.Printf("Latest result before %s", stop)
-			break
+		col := cols[i]
+		if col == nil { // cancelled before this worker got to it
+			continue
 		}
+		AppendColumn(h, nc, grid, rows, *col)
+		log.Printf("found: %s pass:%t %d-%d: %d results", col.Id, col.Passed, col.Started, col.Finished, len(col.Rows))
 	}
-	log.Println("Finished reading builds.")
-	for range builds {
+	if n < len(all) {
+		log.Printf("Stopped after %d builds", n)
 	}
+	log.Println("Finished reading builds.")
 	sort.Stable(Rows(grid.Rows))
-	return *grid
+	return grid, nil
 }
 
 func Days(d float64) time.Duration {
@@ -710,6 +1003,174 @@ func Group(cfg config.Configuration, name string) (*config.TestGroup, bool) {
 	return nil, false
 }
 
+// doctorSampleSize bounds how many of a group's most recent builds doctor
+// mode inspects; auditing every build would be as slow as a full update.
+const doctorSampleSize = 5
+
+// doctorReport describes the audit outcome for a single test group.
+type doctorReport struct {
+	Group    string   `json:"group"`
+	Problems []string `json:"problems,omitempty"`
+}
+
+// String renders the report the way a verbose update would: "group:
+// processed" when clean, or one "group: problem" line per problem found.
+func (r doctorReport) String() string {
+	if len(r.Problems) == 0 {
+		return fmt.Sprintf("%s: processed", r.Group)
+	}
+	lines := make([]string, len(r.Problems))
+	for i, p := range r.Problems {
+		lines[i] = fmt.Sprintf("%s: %s", r.Group, p)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// doctorGroup audits a single test group's config and GCS state without
+// writing anything, returning every problem it finds.
+func doctorGroup(client *storage.Client, ctx context.Context, tg config.TestGroup, deadlines Deadlines) doctorReport {
+	report := doctorReport{Group: tg.Name}
+	problem := func(format string, args ...interface{}) {
+		report.Problems = append(report.Problems, fmt.Sprintf(format, args...))
+	}
+
+	var tgPath gcsPath
+	if err := tgPath.Set("gs://" + tg.GcsPrefix); err != nil {
+		problem("invalid gcs_prefix %q: %v", tg.GcsPrefix, err)
+		return report
+	}
+	if _, err := client.Bucket(tgPath.bucket()).Attrs(ctx); err != nil {
+		problem("bucket %s unreachable: %v", tgPath.bucket(), err)
+		return report
+	}
+
+	builds := make(chan Build)
+	var listErr error
+	go func() {
+		defer close(builds)
+		listErr = listBuilds(client, ctx, tgPath, builds, deadlines)
+	}()
+	var all []Build
+	for b := range builds {
+		all = append(all, b)
+	}
+	if listErr != nil {
+		problem("failed to list builds: %v", listErr)
+		return report
+	}
+	if len(all) == 0 {
+		problem("no builds found under %s", tgPath)
+		return report
+	}
+
+	n := len(all)
+	if n > doctorSampleSize {
+		n = doctorSampleSize
+	}
+
+	headers := Headers(tg)
+	seenHeader := map[string]bool{}
+	nc := MakeNameConfig(tg.TestNameConfig)
+	seenElement := map[string]bool{}
+
+	for _, b := range all[:n] {
+		col, err := ReadBuild(b, 1)
+		if err != nil {
+			problem("%s: %v", b.Prefix, err)
+			continue
+		}
+		for _, h := range headers {
+			if v, ok := col.Metadata[h]; ok && v != "" {
+				seenHeader[h] = true
+			}
+		}
+		for _, rows := range col.Rows {
+			for _, r := range rows {
+				for _, part := range nc.parts {
+					// Mirror Row.Format's own lookup order: row metadata first,
+					// falling back to the build's finished.json metadata.
+					v, ok := r.Metadata[part]
+					if !ok {
+						v, ok = col.Metadata[part]
+					}
+					if ok && v != "" {
+						seenElement[part] = true
+					}
+				}
+			}
+		}
+	}
+
+	for _, h := range headers {
+		if !seenHeader[h] {
+			problem("header %q never appears in finished.json metadata of the last %d builds", h, n)
+		}
+	}
+	for _, part := range nc.parts {
+		if !seenElement[part] {
+			problem("name element %q always produces an empty substitution in the last %d builds", part, n)
+		}
+	}
+
+	return report
+}
+
+// runDoctor audits every configured test group (or just --test-group, if
+// set) and prints a report, returning the number of groups with problems.
+func runDoctor(client *storage.Client, ctx context.Context, cfg config.Configuration, opt options) int {
+	var groups []config.TestGroup
+	if opt.group != "" {
+		tg, ok := Group(cfg, opt.group)
+		if !ok {
+			log.Fatalf("Failed to find %s in %s", opt.group, opt.config)
+		}
+		groups = append(groups, *tg)
+	} else {
+		for _, tg := range cfg.TestGroups {
+			groups = append(groups, *tg)
+		}
+	}
+
+	reports := make([]doctorReport, len(groups))
+	idxs := make(chan int)
+	var wg sync.WaitGroup
+	for i := uint(0); i < opt.groupConcurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range idxs {
+				reports[idx] = doctorGroup(client, ctx, groups[idx], opt.deadlines)
+			}
+		}()
+	}
+	for i := range groups {
+		idxs <- i
+	}
+	close(idxs)
+	wg.Wait()
+
+	problems := 0
+	for _, r := range reports {
+		if len(r.Problems) > 0 {
+			problems++
+		}
+	}
+
+	if opt.doctorJSON {
+		buf, err := json.MarshalIndent(reports, "", "  ")
+		if err != nil {
+			log.Fatalf("Failed to marshal doctor report: %v", err)
+		}
+		fmt.Println(string(buf))
+	} else {
+		for _, r := range reports {
+			fmt.Println(r)
+		}
+	}
+
+	return problems
+}
+
 func main() {
 	opt := gatherOptions()
 	if err := opt.validate(); err != nil {
@@ -731,6 +1192,13 @@ func main() {
 		log.Fatalf("Failed to read %s: %v", opt.config, err)
 	}
 
+	if opt.doctor {
+		if problems := runDoctor(client, ctx, *cfg, opt); problems > 0 {
+			log.Fatalf("doctor found problems in %d test group(s)", problems)
+		}
+		return
+	}
+
 	groups := make(chan config.TestGroup)
 	var wg sync.WaitGroup
 
@@ -738,7 +1206,7 @@ func main() {
 		wg.Add(1)
 		go func() {
 			for tg := range groups {
-				if err := updateGroup(client, ctx, tg, opt.config.testGroup(tg.Name), opt.confirm); err != nil {
+				if err := updateGroup(client, ctx, tg, opt.config.testGroup(tg.Name), opt.confirm, int(opt.buildConcurrency), int(opt.artifactConcurrency), opt.codec, opt.deadlines); err != nil {
 					log.Printf("Update failed: %v", err)
 				}
 			}
@@ -767,7 +1235,7 @@ func main() {
 	wg.Wait()
 }
 
-func updateGroup(client *storage.Client, ctx context.Context, tg config.TestGroup, gridPath gcsPath, write bool) error {
+func updateGroup(client *storage.Client, ctx context.Context, tg config.TestGroup, gridPath gcsPath, write bool, concurrency, artifactConcurrency int, codec Codec, deadlines Deadlines) error {
 	o := tg.Name
 
 	var tgPath gcsPath
@@ -776,17 +1244,24 @@ func updateGroup(client *storage.Client, ctx context.Context, tg config.TestGrou
 	}
 	log.Println(tgPath)
 
-	g := state.Grid{}
-	g.Columns = append(g.Columns, &state.Column{Build: "first", Started: 1})
-	builds, err := listBuilds(client, ctx, tgPath)
-	if err != nil {
-		return fmt.Errorf("failed to list %s builds: %v", o, err)
-	}
-	grid, err := ReadBuilds(ctx, tg, builds, 50, Days(7), concurrency)
+	builds := make(chan Build)
+	var listErr error
+	go func() {
+		defer close(builds)
+		listErr = listBuilds(client, ctx, tgPath, builds, deadlines)
+	}()
+
+	grid, err := ReadBuilds(ctx, tg, builds, 50, Days(7), concurrency, artifactConcurrency)
 	if err != nil {
 		return err
 	}
-	buf, err := marshalGrid(*grid)
+	if listErr != nil {
+		// listBuilds failed outright (rather than merely stopping early on a
+		// slow page), and it sends no builds when it fails, so the grid is
+		// empty: don't overwrite the existing grid with it.
+		return fmt.Errorf("failed to list %s builds: %v", o, listErr)
+	}
+	buf, err := marshalGrid(*grid, codec)
 	if err != nil {
 		return fmt.Errorf("failed to marhsal %s grid: %v", o, err)
 	}
@@ -796,7 +1271,7 @@ func updateGroup(client *storage.Client, ctx context.Context, tg config.TestGrou
 		log.Printf("Not writing %s (%d bytes) to %s", o, len(buf), tgp)
 	} else {
 		log.Printf("  Writing %s (%d bytes) to %s", o, len(buf), tgp)
-		if err := uploadBytes(client, ctx, tgp, buf); err != nil {
+		if err := uploadBytes(client, ctx, tgp, buf, codec.Name()); err != nil {
 			return fmt.Errorf("upload %s to %s failed: %v", o, tgp, err)
 		}
 	}
@@ -804,9 +1279,42 @@ func updateGroup(client *storage.Client, ctx context.Context, tg config.TestGrou
 	return nil
 }
 
-// marhshalGrid serializes a state proto into zlib-compressed bytes and its crc32 checksum.
-func marshalGrid(grid state.Grid) ([]byte, error) {
-	buf, err := proto.Marshal(&grid)
+// Codec (de)serializes a proto.Message to/from bytes, typically applying
+// some compression. The grid uploaded to GCS records which Codec produced it
+// (see uploadBytes) so a later reader can pick the matching Unmarshal.
+type Codec interface {
+	Name() string
+	Marshal(proto.Message) ([]byte, error)
+	Unmarshal([]byte, proto.Message) error
+}
+
+// codecs holds every Codec this binary knows how to read and write, keyed by
+// the name recorded in an object's "testgrid-codec" metadata.
+var codecs = map[string]Codec{
+	"zlib": zlibCodec{},
+	"zstd": zstdCodec{},
+	"lz4":  lz4Codec{},
+}
+
+// codecByName looks up a registered Codec, erroring on anything unknown so
+// --grid-codec typos fail loudly. Nothing in this binary reads an uploaded
+// grid's "testgrid-codec" metadata back, so it is only used for the flag.
+func codecByName(name string) (Codec, error) {
+	codec, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown codec %q", name)
+	}
+	return codec, nil
+}
+
+// zlibCodec is the original, backward-compatible codec used by grids written
+// before codecs became pluggable.
+type zlibCodec struct{}
+
+func (zlibCodec) Name() string { return "zlib" }
+
+func (zlibCodec) Marshal(m proto.Message) ([]byte, error) {
+	buf, err := proto.Marshal(m)
 	if err != nil {
 		return nil, fmt.Errorf("proto encoding failed: %v", err)
 	}
@@ -821,12 +1329,95 @@ func marshalGrid(grid state.Grid) ([]byte, error) {
 	return zbuf.Bytes(), nil
 }
 
+func (zlibCodec) Unmarshal(buf []byte, m proto.Message) error {
+	zr, err := zlib.NewReader(bytes.NewReader(buf))
+	if err != nil {
+		return fmt.Errorf("zlib reader failed: %v", err)
+	}
+	defer zr.Close()
+	raw, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return fmt.Errorf("zlib decompression failed: %v", err)
+	}
+	return proto.Unmarshal(raw, m)
+}
+
+// zstdCodec trades a slower encode for a much better ratio on state.Grid
+// protos, which are dominated by long runs of identical Row_Result values
+// and repeated cell IDs/messages.
+type zstdCodec struct{}
+
+func (zstdCodec) Name() string { return "zstd" }
+
+func (zstdCodec) Marshal(m proto.Message) ([]byte, error) {
+	buf, err := proto.Marshal(m)
+	if err != nil {
+		return nil, fmt.Errorf("proto encoding failed: %v", err)
+	}
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, fmt.Errorf("zstd writer failed: %v", err)
+	}
+	defer enc.Close()
+	return enc.EncodeAll(buf, nil), nil
+}
+
+func (zstdCodec) Unmarshal(buf []byte, m proto.Message) error {
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		return fmt.Errorf("zstd reader failed: %v", err)
+	}
+	defer dec.Close()
+	raw, err := dec.DecodeAll(buf, nil)
+	if err != nil {
+		return fmt.Errorf("zstd decompression failed: %v", err)
+	}
+	return proto.Unmarshal(raw, m)
+}
+
+// lz4Codec favors encode/decode speed over ratio, for callers that would
+// rather spend GCS egress than CPU.
+type lz4Codec struct{}
+
+func (lz4Codec) Name() string { return "lz4" }
+
+func (lz4Codec) Marshal(m proto.Message) ([]byte, error) {
+	buf, err := proto.Marshal(m)
+	if err != nil {
+		return nil, fmt.Errorf("proto encoding failed: %v", err)
+	}
+	var lbuf bytes.Buffer
+	lw := lz4.NewWriter(&lbuf)
+	if _, err := lw.Write(buf); err != nil {
+		return nil, fmt.Errorf("lz4 compression failed: %v", err)
+	}
+	if err := lw.Close(); err != nil {
+		return nil, fmt.Errorf("lz4 closing failed: %v", err)
+	}
+	return lbuf.Bytes(), nil
+}
+
+func (lz4Codec) Unmarshal(buf []byte, m proto.Message) error {
+	raw, err := ioutil.ReadAll(lz4.NewReader(bytes.NewReader(buf)))
+	if err != nil {
+		return fmt.Errorf("lz4 decompression failed: %v", err)
+	}
+	return proto.Unmarshal(raw, m)
+}
+
+// marshalGrid serializes a state proto using codec.
+func marshalGrid(grid state.Grid, codec Codec) ([]byte, error) {
+	return codec.Marshal(&grid)
+}
+
 func calcCRC(buf []byte) uint32 {
 	return crc32.Checksum(buf, crc32.MakeTable(crc32.Castagnoli))
 }
 
-// uploadBytes writes bytes to the specified gcsPath
-func uploadBytes(client *storage.Client, ctx context.Context, path gcsPath, buf []byte) error {
+// uploadBytes writes bytes to the specified gcsPath, recording codec in the
+// object's metadata and content encoding so a later reader knows how to
+// decompress it.
+func uploadBytes(client *storage.Client, ctx context.Context, path gcsPath, buf []byte, codec string) error {
 	crc := calcCRC(buf)
 	w := client.Bucket(path.bucket()).Object(path.object()).NewWriter(ctx)
 	w.SendCRC32C = true
@@ -834,6 +1425,8 @@ func uploadBytes(client *storage.Client, ctx context.Context, path gcsPath, buf
 	// See checksum example at:
 	// https://godoc.org/cloud.google.com/go/storage#Writer.Write
 	w.ObjectAttrs.CRC32C = crc
+	w.ObjectAttrs.ContentEncoding = codec
+	w.ObjectAttrs.Metadata = map[string]string{"testgrid-codec": codec}
 	w.ProgressFunc = func(bytes int64) {
 		log.Printf("Uploading %s: %d/%d...", path, bytes, len(buf))
 	}
@@ -0,0 +1,330 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"k8s.io/test-infra/testgrid/config"
+	"k8s.io/test-infra/testgrid/state"
+)
+
+func TestForEachJobRunsEveryIndexOnce(t *testing.T) {
+	const n = 200
+	var seen [n]int32
+	err := ForEachJob(context.Background(), 8, n, func(ctx context.Context, i int) error {
+		atomic.AddInt32(&seen[i], 1)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ForEachJob returned %v, want nil", err)
+	}
+	for i, c := range seen {
+		if c != 1 {
+			t.Errorf("index %d ran %d times, want exactly 1", i, c)
+		}
+	}
+}
+
+func TestForEachJobBoundsConcurrency(t *testing.T) {
+	const concurrency = 3
+	var cur, max int32
+	err := ForEachJob(context.Background(), concurrency, 50, func(ctx context.Context, i int) error {
+		n := atomic.AddInt32(&cur, 1)
+		for {
+			m := atomic.LoadInt32(&max)
+			if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+				break
+			}
+		}
+		atomic.AddInt32(&cur, -1)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ForEachJob returned %v, want nil", err)
+	}
+	if max > concurrency {
+		t.Errorf("observed %d concurrent workers, want at most %d", max, concurrency)
+	}
+}
+
+func TestForEachJobStopsOnFirstError(t *testing.T) {
+	want := errors.New("boom")
+	var started int32
+	err := ForEachJob(context.Background(), 1, 100, func(ctx context.Context, i int) error {
+		atomic.AddInt32(&started, 1)
+		if i == 0 {
+			return want
+		}
+		<-ctx.Done() // later jobs should observe cancellation rather than run to completion
+		return ctx.Err()
+	})
+	if !errors.Is(err, want) {
+		t.Fatalf("ForEachJob returned %v, want %v", err, want)
+	}
+	if n := atomic.LoadInt32(&started); n == 0 {
+		t.Fatal("no jobs ran at all")
+	}
+}
+
+func TestForEachJobEmpty(t *testing.T) {
+	called := false
+	err := ForEachJob(context.Background(), 4, 0, func(ctx context.Context, i int) error {
+		called = true
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ForEachJob returned %v, want nil", err)
+	}
+	if called {
+		t.Fatal("fn was called for n == 0")
+	}
+}
+
+// TestNextAttrsTimeoutDoesNotWaitForAGenuineHang exercises nextAttrs against
+// a listing call that never returns at all, not just one that's slow: the
+// per-object deadline must fire promptly even though the underlying RPC
+// stays stuck forever, since that's the "pathologically large prefix" /
+// "hanging object" scenario this is meant to fix.
+func TestNextAttrsTimeoutDoesNotWaitForAGenuineHang(t *testing.T) {
+	client := fakeClient(t, nil, time.Hour)
+	bkt := client.Bucket("bucket")
+	ctx := context.Background()
+	it := bkt.Objects(ctx, &storage.Query{Delimiter: "/", Prefix: "group/"})
+
+	start := time.Now()
+	_, err := nextAttrs(ctx, it, 50*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("nextAttrs took %s to return, want it to return promptly after the per-object deadline regardless of the hung call", elapsed)
+	}
+	if !errors.Is(err, ErrDeadlineExceeded) {
+		t.Fatalf("nextAttrs returned %v, want %v", err, ErrDeadlineExceeded)
+	}
+}
+
+// TestListBuildsProceedsPastAHungPage verifies listBuilds itself returns
+// (with whatever it already found, here nothing) instead of hanging forever
+// when a single listing call is stuck, so one bad prefix can't wedge the
+// whole updater.
+func TestListBuildsProceedsPastAHungPage(t *testing.T) {
+	client := fakeClient(t, nil, time.Hour)
+	var path gcsPath
+	if err := path.Set("gs://bucket/group/"); err != nil {
+		t.Fatalf("path.Set() returned %v", err)
+	}
+
+	builds := make(chan Build, 1) // generous capacity: a hung first page sends nothing
+
+	done := make(chan error, 1)
+	go func() {
+		done <- listBuilds(client, context.Background(), path, builds, Deadlines{PerObject: 50 * time.Millisecond})
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("listBuilds returned %v, want nil (a hung page should end the listing early, not fail it)", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("listBuilds did not return: a single hung page hung the whole listing")
+	}
+}
+
+// TestReadBuildsPreservesOrderDespiteOutOfOrderCompletion drives ReadBuilds
+// against several builds concurrently, one of which is deliberately slow, to
+// verify the resulting grid.Columns keep the channel's most-recent-first
+// order regardless of which worker happens to finish first.
+func TestReadBuildsPreservesOrderDespiteOutOfOrderCompletion(t *testing.T) {
+	const n = 6
+	var objects []fakeObject
+	for i := 0; i < n; i++ {
+		prefix := fmt.Sprintf("group/build-%d/", i)
+		objects = append(objects,
+			fakeObject{name: prefix + "started.json", data: []byte(fmt.Sprintf(`{"timestamp": %d}`, 1000+i))},
+			fakeObject{name: prefix + "finished.json", data: []byte(fmt.Sprintf(`{"timestamp": %d, "passed": true}`, 1000+i))},
+		)
+	}
+	// Delay the first (most-recent) build's finished.json so it can only
+	// complete after later-queued, less-recent builds have already
+	// finished -- exercising the out-of-order completion path.
+	for i := range objects {
+		if objects[i].name == "group/build-5/finished.json" {
+			objects[i].delay = 200 * time.Millisecond
+		}
+	}
+	client := fakeClient(t, objects, 0)
+	bkt := client.Bucket("bucket")
+
+	builds := make(chan Build, n)
+	for i := n - 1; i >= 0; i-- { // most-recent-first, matching listBuilds' contract
+		builds <- Build{Bucket: bkt, Context: context.Background(), Prefix: fmt.Sprintf("group/build-%d/", i)}
+	}
+	close(builds)
+
+	grid, err := ReadBuilds(context.Background(), config.TestGroup{}, builds, 0, 0, 4, 4)
+	if err != nil {
+		t.Fatalf("ReadBuilds() returned %v", err)
+	}
+	if len(grid.Columns) != n {
+		t.Fatalf("got %d columns, want %d", len(grid.Columns), n)
+	}
+	for i, c := range grid.Columns {
+		want := fmt.Sprintf("build-%d", n-1-i)
+		if c.Build != want {
+			t.Errorf("column %d has Build %q, want %q: columns must stay in most-recent-first order regardless of which worker finished first", i, c.Build, want)
+		}
+	}
+}
+
+// TestReadBuildCancelsInFlightArtifactFetchesOnError verifies that once one
+// artifact fails to parse, ReadBuild's artifact fan-out cancels rather than
+// waiting for the other (here: hung) in-flight fetches to finish.
+func TestReadBuildCancelsInFlightArtifactFetchesOnError(t *testing.T) {
+	const prefix = "group/build-9/"
+	objects := []fakeObject{
+		{name: prefix + "started.json", data: []byte(`{"timestamp": 1000}`)},
+		{name: prefix + "finished.json", data: []byte(`{"timestamp": 1001, "passed": true}`)},
+		{name: prefix + "artifacts/junit_bad.xml", data: []byte("not xml at all")},
+	}
+	for i := 0; i < 20; i++ {
+		objects = append(objects, fakeObject{
+			name:  fmt.Sprintf("%sartifacts/junit_good_%d.xml", prefix, i),
+			data:  []byte(`<testsuites></testsuites>`),
+			delay: time.Hour, // would hang the test if ReadBuild didn't cancel these in flight
+		})
+	}
+	client := fakeClient(t, objects, 0)
+	bkt := client.Bucket("bucket")
+
+	build := Build{Bucket: bkt, Context: context.Background(), Prefix: prefix}
+	done := make(chan error, 1)
+	go func() {
+		// One worker per artifact, so every fetch (the bad one included) is in
+		// flight at once whatever order ReadBuild picks them up in.
+		_, err := ReadBuild(build, len(objects))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("ReadBuild returned nil error, want the bad artifact's parse error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReadBuild did not return: cancelling on the bad artifact should have stopped the other (hung) in-flight fetches")
+	}
+}
+
+// testGrid builds a *state.Grid with cols columns and rows rows, roughly
+// shaped like a real grid: long runs of identical results punctuated by a
+// failure, which is the case the zlib/zstd/lz4 codecs are meant to compress
+// well.
+func testGrid(cols, rows int) *state.Grid {
+	g := &state.Grid{}
+	for c := 0; c < cols; c++ {
+		g.Columns = append(g.Columns, &state.Column{
+			Build:   fmt.Sprintf("build-%d", c),
+			Started: float64(c) * 1000,
+		})
+	}
+	for r := 0; r < rows; r++ {
+		row := &state.Row{
+			Name: fmt.Sprintf("//some/test:target_%d", r),
+			Id:   fmt.Sprintf("target_%d", r),
+		}
+		for c := 0; c < cols; c++ {
+			result := state.Row_PASS
+			if c%17 == 0 {
+				result = state.Row_FAIL
+			}
+			AppendResult(row, result, 1)
+		}
+		g.Rows = append(g.Rows, row)
+	}
+	return g
+}
+
+func TestCodecsRoundTrip(t *testing.T) {
+	grid := testGrid(50, 200)
+	for name, codec := range codecs {
+		t.Run(name, func(t *testing.T) {
+			buf, err := codec.Marshal(grid)
+			if err != nil {
+				t.Fatalf("Marshal() returned %v", err)
+			}
+			var got state.Grid
+			if err := codec.Unmarshal(buf, &got); err != nil {
+				t.Fatalf("Unmarshal() returned %v", err)
+			}
+			if !reflect.DeepEqual(grid, &got) {
+				t.Errorf("round trip through %s changed the grid", name)
+			}
+		})
+	}
+}
+
+func TestCodecByName(t *testing.T) {
+	for name := range codecs {
+		codec, err := codecByName(name)
+		if err != nil {
+			t.Fatalf("codecByName(%q) returned %v", name, err)
+		}
+		if codec.Name() != name {
+			t.Errorf("codecByName(%q).Name() = %q, want %q", name, codec.Name(), name)
+		}
+	}
+	if _, err := codecByName("bogus"); err == nil {
+		t.Error("codecByName(\"bogus\") returned nil error, want an error")
+	}
+}
+
+func BenchmarkCodecs(b *testing.B) {
+	grid := testGrid(200, 2000)
+	for name, codec := range codecs {
+		b.Run(name+"/marshal", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := codec.Marshal(grid); err != nil {
+					b.Fatalf("Marshal() returned %v", err)
+				}
+			}
+		})
+		buf, err := codec.Marshal(grid)
+		if err != nil {
+			b.Fatalf("Marshal() returned %v", err)
+		}
+		b.Run(name+"/size", func(b *testing.B) {
+			b.ReportMetric(float64(len(buf)), "bytes")
+		})
+		b.Run(name+"/unmarshal", func(b *testing.B) {
+			b.ReportAllocs()
+			var out state.Grid
+			for i := 0; i < b.N; i++ {
+				if err := codec.Unmarshal(buf, &out); err != nil {
+					b.Fatalf("Unmarshal() returned %v", err)
+				}
+			}
+		})
+	}
+}